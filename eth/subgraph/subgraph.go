@@ -2,6 +2,7 @@ package subgraph
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,15 +10,50 @@ import (
 	"math/big"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/golang/glog"
 	"github.com/livepeer/go-livepeer/common"
+	"github.com/livepeer/go-livepeer/eth"
 	lpTypes "github.com/livepeer/go-livepeer/eth/types"
 )
 
+// pageSize is the number of entities requested per page. The subgraph caps
+// unbounded queries at 100 results, so anything beyond that requires
+// `first`/`id_gt` pagination. It's only a request hint, not a guarantee:
+// getActiveTranscodersFromSubgraph terminates on an empty page rather than
+// assuming the server honored it.
+const pageSize = 1000
+
+// defaultMaxBlocksBehind is the default number of blocks the subgraph's
+// indexed head (`_meta.block.number`) is allowed to lag behind the chain
+// head before it is considered stale and results fall back on-chain.
+const defaultMaxBlocksBehind = 50
+
+// TranscoderSource identifies where a set of active transcoders came from.
+type TranscoderSource string
+
+const (
+	// TranscoderSourceSubgraph indicates the result was served by the subgraph.
+	TranscoderSourceSubgraph TranscoderSource = "subgraph"
+	// TranscoderSourceOnChain indicates the subgraph was unavailable or stale
+	// and the result was assembled on-chain instead.
+	TranscoderSourceOnChain TranscoderSource = "onchain"
+)
+
+// TranscodersResult wraps the active transcoder set along with metadata
+// describing how it was produced, so callers can surface degraded-mode
+// status when the subgraph fell back to on-chain reads.
+type TranscodersResult struct {
+	Transcoders []*lpTypes.Transcoder
+	Source      TranscoderSource
+}
+
 type LivepeerSubgraph interface {
-	GetActiveTranscoders() ([]*lpTypes.Transcoder, error)
+	GetActiveTranscoders() (*TranscodersResult, error)
+	Subscribe(ctx context.Context, sink chan<- []*lpTypes.Transcoder) error
 }
 
 type httpClient interface {
@@ -25,12 +61,27 @@ type httpClient interface {
 }
 
 type livepeerSubgraph struct {
-	http httpClient
-	addr string
+	http            httpClient
+	addr            string
+	lpEth           eth.LivepeerEthClient
+	maxBlocksBehind int64
 }
 
 type data struct {
-	Data map[string]json.RawMessage
+	Data   map[string]json.RawMessage
+	Errors []graphqlError `json:"errors"`
+}
+
+type graphqlError struct {
+	Message string `json:"message"`
+}
+
+type metaBlock struct {
+	Number int64 `json:"number"`
+}
+
+type meta struct {
+	Block metaBlock `json:"block"`
 }
 
 func NewLivepeerSubgraph(addr string, timeout time.Duration) (*livepeerSubgraph, error) {
@@ -46,73 +97,210 @@ func NewLivepeerSubgraph(addr string, timeout time.Duration) (*livepeerSubgraph,
 	}, nil
 }
 
-func (s *livepeerSubgraph) GetActiveTranscoders() ([]*lpTypes.Transcoder, error) {
+// NewLivepeerSubgraphWithFallback creates a LivepeerSubgraph that, whenever
+// the subgraph query fails outright (non-2xx response, GraphQL `errors`,
+// request timeout) or returns data indexed more than maxBlocksBehind blocks
+// behind the chain head, transparently falls back to assembling the active
+// transcoder set from on-chain reads via lpEth.
+func NewLivepeerSubgraphWithFallback(addr string, timeout time.Duration, lpEth eth.LivepeerEthClient, maxBlocksBehind int64) (*livepeerSubgraph, error) {
+	s, err := NewLivepeerSubgraph(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.lpEth = lpEth
+	if maxBlocksBehind <= 0 {
+		maxBlocksBehind = defaultMaxBlocksBehind
+	}
+	s.maxBlocksBehind = maxBlocksBehind
+	return s, nil
+}
+
+func (s *livepeerSubgraph) GetActiveTranscoders() (*TranscodersResult, error) {
+	transcoders, err := s.getActiveTranscodersFromSubgraph()
+	if err != nil {
+		if s.lpEth == nil {
+			return nil, err
+		}
+		glog.Errorf("subgraph query failed, falling back to on-chain reads err=%v", err)
+		return s.getActiveTranscodersOnChain()
+	}
+
+	return &TranscodersResult{
+		Transcoders: transcoders,
+		Source:      TranscoderSourceSubgraph,
+	}, nil
+}
+
+// getActiveTranscodersFromSubgraph pages through the subgraph's
+// `transcoders` collection using `id_gt` cursoring until an empty page is
+// returned, aggregating results across pages. Unlike a `skip`-based
+// termination check (stop once a page comes back shorter than pageSize),
+// this doesn't depend on the server actually honoring the requested
+// `first`: a subgraph deployment with a lower page size ceiling just means
+// more, smaller pages, never a truncated result. It also checks
+// `_meta.block.number` against the chain head and treats a stale index as a
+// query failure so the caller can fall back.
+func (s *livepeerSubgraph) getActiveTranscodersFromSubgraph() ([]*lpTypes.Transcoder, error) {
+	transcoders := []*lpTypes.Transcoder{}
+	lastID := ""
+	var blockNumber int64
+	for {
+		page, bn, err := s.fetchTranscoderPage(lastID)
+		if err != nil {
+			return nil, err
+		}
+		blockNumber = bn
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, t := range page {
+			transcoders = append(transcoders, t.parseLivepeerTranscoder())
+		}
+		lastID = page[len(page)-1].ID
+	}
+
+	if err := s.checkStaleness(blockNumber); err != nil {
+		return nil, err
+	}
+
+	return transcoders, nil
+}
+
+// transcoderFields is the selection set used whenever we ask the subgraph
+// for transcoder entities, shared between the paginated query and the
+// subscription so the two can never drift apart.
+const transcoderFields = `
+	id
+	feeShare
+	rewardCut
+	lastRewardRound {
+		id
+	}
+	activationRound
+	deactivationRound
+	totalStake
+	serviceURI
+	active
+	status
+	pools (first: 1, orderBy: id, orderDirection: desc) {
+		totalStake
+	}
+`
+
+func (s *livepeerSubgraph) fetchTranscoderPage(lastID string) ([]*transcoder, int64, error) {
 	query := map[string]string{
-		"query": `
+		"query": fmt.Sprintf(`
 		{
-			transcoders(where: {active: true}) {
-			  	id
-			  	feeShare
-			 	rewardCut
-			  	lastRewardRound {
-					id
-			  	}
-			  	activationRound
-			  	deactivationRound
-			  	totalStake
-				serviceURI
-			  	active
-				status
-				pools (first: 1, orderBy: id, orderDirection: desc) {
-					totalStake
+			transcoders(where: {active: true, id_gt: %q}, first: %d, orderBy: id, orderDirection: asc) {
+				%s
+			}
+			_meta {
+				block {
+					number
 				}
 			}
 		  }
-		`,
+		`, lastID, pageSize, transcoderFields),
 	}
 
 	input, err := json.Marshal(query)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	req, err := http.NewRequest("POST", s.addr, bytes.NewBuffer(input))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	res, err := s.http.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	body, err := ioutil.ReadAll(res.Body)
 	defer res.Body.Close()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, errors.New(string(body))
+		return nil, 0, errors.New(string(body))
 	}
 
-	data := data{
+	d := data{
 		Data: make(map[string]json.RawMessage),
 	}
 
-	if err := json.Unmarshal(body, &data); err != nil {
-		return nil, err
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, 0, err
+	}
+
+	if len(d.Errors) > 0 {
+		return nil, 0, fmt.Errorf("subgraph returned errors: %v", d.Errors)
 	}
 
 	transcodersJSON := []*transcoder{}
-	if err := json.Unmarshal([]byte(data.Data["transcoders"]), &transcodersJSON); err != nil {
+	if err := json.Unmarshal([]byte(d.Data["transcoders"]), &transcodersJSON); err != nil {
+		return nil, 0, err
+	}
+
+	m := meta{}
+	if raw, ok := d.Data["_meta"]; ok {
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return transcodersJSON, m.Block.Number, nil
+}
+
+func (s *livepeerSubgraph) checkStaleness(subgraphBlockNumber int64) error {
+	if s.lpEth == nil || s.maxBlocksBehind <= 0 {
+		return nil
+	}
+	latest, err := s.lpEth.LatestBlockNum()
+	if err != nil {
+		return err
+	}
+	if latest.Int64()-subgraphBlockNumber > s.maxBlocksBehind {
+		return fmt.Errorf("subgraph is %d blocks behind chain head", latest.Int64()-subgraphBlockNumber)
+	}
+	return nil
+}
+
+// getActiveTranscodersOnChain assembles the active transcoder set directly
+// from chain reads, used as a fallback when the subgraph is unavailable or
+// stale. GetTranscoder is fetched concurrently across the pool since this
+// path is only taken when the subgraph is already degraded and latency
+// matters most.
+func (s *livepeerSubgraph) getActiveTranscodersOnChain() (*TranscodersResult, error) {
+	pool, err := s.lpEth.TranscoderPool()
+	if err != nil {
 		return nil, err
 	}
 
-	transcoders := []*lpTypes.Transcoder{}
+	transcoders := make([]*lpTypes.Transcoder, len(pool))
+	errs := make([]error, len(pool))
+	var wg sync.WaitGroup
+	for i, addr := range pool {
+		wg.Add(1)
+		go func(i int, addr ethcommon.Address) {
+			defer wg.Done()
+			transcoders[i], errs[i] = s.lpEth.GetTranscoder(addr)
+		}(i, addr)
+	}
+	wg.Wait()
 
-	for _, t := range transcodersJSON {
-		transcoders = append(transcoders, t.parseLivepeerTranscoder())
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return transcoders, nil
+	return &TranscodersResult{
+		Transcoders: transcoders,
+		Source:      TranscoderSourceOnChain,
+	}, nil
 }
 
 type bigInt struct {
@@ -179,4 +367,4 @@ func (t *transcoder) parseLivepeerTranscoder() *lpTypes.Transcoder {
 
 type round struct {
 	Number bigInt `json:"id"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,269 @@
+package subgraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/livepeer/go-livepeer/eth"
+	lpTypes "github.com/livepeer/go-livepeer/eth/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testTranscoderAddr = ethcommon.HexToAddress("0x3333333333333333333333333333333333333333")
+
+// fakeHTTPClient is a minimal stand-in for httpClient. Responses are served
+// in call order; the raw GraphQL query bodies are recorded so tests can
+// assert on the id_gt cursor sent with each page.
+type fakeHTTPClient struct {
+	responses []fakeResponse
+	calls     int
+	queries   []string
+}
+
+type fakeResponse struct {
+	status int
+	body   string
+	err    error
+}
+
+func (c *fakeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var q struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(body, &q); err != nil {
+		return nil, err
+	}
+	c.queries = append(c.queries, q.Query)
+
+	if c.calls >= len(c.responses) {
+		return nil, fmt.Errorf("fakeHTTPClient: no response configured for call %d", c.calls)
+	}
+	res := c.responses[c.calls]
+	c.calls++
+	if res.err != nil {
+		return nil, res.err
+	}
+	return &http.Response{
+		StatusCode: res.status,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(res.body)),
+	}, nil
+}
+
+// fakeLpEth is a minimal stand-in for eth.LivepeerEthClient, used to drive
+// the staleness check and the on-chain fallback path.
+type fakeLpEth struct {
+	eth.LivepeerEthClient
+
+	latestBlockNum    *big.Int
+	latestBlockNumErr error
+
+	pool    []ethcommon.Address
+	poolErr error
+
+	transcoders map[ethcommon.Address]*lpTypes.Transcoder
+}
+
+func (f *fakeLpEth) LatestBlockNum() (*big.Int, error) {
+	return f.latestBlockNum, f.latestBlockNumErr
+}
+
+func (f *fakeLpEth) TranscoderPool() ([]ethcommon.Address, error) {
+	return f.pool, f.poolErr
+}
+
+func (f *fakeLpEth) GetTranscoder(addr ethcommon.Address) (*lpTypes.Transcoder, error) {
+	return f.transcoders[addr], nil
+}
+
+func transcodersPageBody(blockNumber int64, ids ...string) string {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = fmt.Sprintf(`{
+			"id": %q,
+			"feeShare": "0",
+			"rewardCut": "0",
+			"lastRewardRound": {"id": "0"},
+			"activationRound": "0",
+			"deactivationRound": "0",
+			"totalStake": "0",
+			"serviceURI": "",
+			"active": true,
+			"status": "Registered",
+			"pools": []
+		}`, id)
+	}
+	return fmt.Sprintf(`{"data": {"transcoders": [%s], "_meta": {"block": {"number": %d}}}}`, strings.Join(entries, ","), blockNumber)
+}
+
+func TestGetActiveTranscodersFromSubgraph_PaginatesUntilEmptyPage(t *testing.T) {
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{status: 200, body: transcodersPageBody(100, "0xaaa", "0xbbb")},
+		{status: 200, body: transcodersPageBody(100)},
+	}}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example"}
+
+	transcoders, err := s.getActiveTranscodersFromSubgraph()
+	require.NoError(t, err)
+	assert.Len(t, transcoders, 2)
+	assert.Len(t, httpClient.queries, 2, "must keep paging until an empty page is returned")
+	assert.Contains(t, httpClient.queries[1], `id_gt: "0xbbb"`, "second page must cursor from the last id of the first")
+}
+
+func TestGetActiveTranscodersFromSubgraph_SinglePageWhenFirstIsEmpty(t *testing.T) {
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{status: 200, body: transcodersPageBody(100)},
+	}}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example"}
+
+	transcoders, err := s.getActiveTranscodersFromSubgraph()
+	require.NoError(t, err)
+	assert.Empty(t, transcoders)
+	assert.Len(t, httpClient.queries, 1)
+}
+
+func TestGetActiveTranscodersFromSubgraph_ShortPageIsNotTreatedAsLastPage(t *testing.T) {
+	// A page shorter than pageSize used to be (incorrectly) treated as the
+	// final page. A subgraph deployment that caps `first` below pageSize
+	// would return short-but-nonempty pages well before the data is
+	// actually exhausted, so pagination must keep going regardless of page
+	// length and only stop on a truly empty page.
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{status: 200, body: transcodersPageBody(100, "0xaaa")},
+		{status: 200, body: transcodersPageBody(100, "0xbbb")},
+		{status: 200, body: transcodersPageBody(100)},
+	}}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example"}
+
+	transcoders, err := s.getActiveTranscodersFromSubgraph()
+	require.NoError(t, err)
+	assert.Len(t, transcoders, 2)
+	assert.Len(t, httpClient.queries, 3)
+}
+
+func TestCheckStaleness(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxBlocksBehind     int64
+		subgraphBlockNumber int64
+		latestBlockNum      *big.Int
+		latestBlockNumErr   error
+		lpEthNil            bool
+		wantErr             bool
+	}{
+		{
+			name:                "within threshold",
+			maxBlocksBehind:     50,
+			subgraphBlockNumber: 100,
+			latestBlockNum:      big.NewInt(120),
+			wantErr:             false,
+		},
+		{
+			name:                "exactly at threshold",
+			maxBlocksBehind:     50,
+			subgraphBlockNumber: 100,
+			latestBlockNum:      big.NewInt(150),
+			wantErr:             false,
+		},
+		{
+			name:                "one block past threshold",
+			maxBlocksBehind:     50,
+			subgraphBlockNumber: 100,
+			latestBlockNum:      big.NewInt(151),
+			wantErr:             true,
+		},
+		{
+			name:                "no lpEth configured skips the check",
+			maxBlocksBehind:     1,
+			subgraphBlockNumber: 0,
+			lpEthNil:            true,
+			wantErr:             false,
+		},
+		{
+			name:                "maxBlocksBehind disabled skips the check",
+			maxBlocksBehind:     0,
+			subgraphBlockNumber: 0,
+			latestBlockNum:      big.NewInt(1000),
+			wantErr:             false,
+		},
+		{
+			name:                "propagates LatestBlockNum error",
+			maxBlocksBehind:     50,
+			subgraphBlockNumber: 100,
+			latestBlockNumErr:   errors.New("rpc unavailable"),
+			wantErr:             true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &livepeerSubgraph{maxBlocksBehind: tt.maxBlocksBehind}
+			if !tt.lpEthNil {
+				s.lpEth = &fakeLpEth{latestBlockNum: tt.latestBlockNum, latestBlockNumErr: tt.latestBlockNumErr}
+			}
+
+			err := s.checkStaleness(tt.subgraphBlockNumber)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGetActiveTranscoders_FallsBackOnSubgraphError(t *testing.T) {
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{err: errors.New("connection refused")},
+	}}
+	lpEth := &fakeLpEth{
+		pool:        []ethcommon.Address{testTranscoderAddr},
+		transcoders: map[ethcommon.Address]*lpTypes.Transcoder{testTranscoderAddr: {Address: testTranscoderAddr}},
+	}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example", lpEth: lpEth}
+
+	res, err := s.GetActiveTranscoders()
+	require.NoError(t, err)
+	assert.Equal(t, TranscoderSourceOnChain, res.Source)
+	require.Len(t, res.Transcoders, 1)
+	assert.Equal(t, testTranscoderAddr, res.Transcoders[0].Address)
+}
+
+func TestGetActiveTranscoders_NoFallbackWhenLpEthNil(t *testing.T) {
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{err: errors.New("connection refused")},
+	}}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example"}
+
+	_, err := s.GetActiveTranscoders()
+	assert.Error(t, err)
+}
+
+func TestGetActiveTranscoders_FallsBackWhenSubgraphIsStale(t *testing.T) {
+	httpClient := &fakeHTTPClient{responses: []fakeResponse{
+		{status: 200, body: transcodersPageBody(100, "0xaaa")},
+		{status: 200, body: transcodersPageBody(100)},
+	}}
+	lpEth := &fakeLpEth{
+		latestBlockNum: big.NewInt(1000), // far beyond maxBlocksBehind of the indexed block 100
+		pool:           []ethcommon.Address{testTranscoderAddr},
+		transcoders:    map[ethcommon.Address]*lpTypes.Transcoder{testTranscoderAddr: {Address: testTranscoderAddr}},
+	}
+	s := &livepeerSubgraph{http: httpClient, addr: "http://subgraph.example", lpEth: lpEth, maxBlocksBehind: 50}
+
+	res, err := s.GetActiveTranscoders()
+	require.NoError(t, err)
+	assert.Equal(t, TranscoderSourceOnChain, res.Source)
+}
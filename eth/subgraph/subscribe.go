@@ -0,0 +1,271 @@
+package subgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	lpTypes "github.com/livepeer/go-livepeer/eth/types"
+)
+
+// graphqlTransportWS is the websocket subprotocol used by the
+// graphql-transport-ws protocol (the successor to the older graphql-ws
+// protocol). It is the only subprotocol offered: the older graphql-ws
+// protocol is not attempted, and a server that rejects this one is polled
+// over HTTP instead.
+const graphqlTransportWS = "graphql-transport-ws"
+
+const (
+	wsHandshakeTimeout = 10 * time.Second
+	wsPingInterval     = 30 * time.Second
+	// wsReadTimeout bounds how long we'll wait for any frame (a server
+	// push, or the pong our own keepalive ping should provoke) before
+	// treating the connection as dead. It must be bigger than
+	// wsPingInterval or every idle-but-healthy connection would time out
+	// between pings.
+	wsReadTimeout = 2 * wsPingInterval
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+
+	pollInterval = 15 * time.Second
+)
+
+// wsMessage is a single graphql-transport-ws protocol frame.
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type subscribePayload struct {
+	Query string `json:"query"`
+}
+
+type nextPayload struct {
+	Data struct {
+		Transcoders []*transcoder `json:"transcoders"`
+	} `json:"data"`
+}
+
+// Subscribe opens a graphql-transport-ws connection to the subgraph and
+// streams the active transcoder set to sink every time it changes,
+// reconnecting with exponential backoff on failure. If the server does not
+// speak the subscription protocol, it falls back to polling
+// GetActiveTranscoders on pollInterval. Subscribe returns once the
+// connection loop has been started; ctx cancellation stops it.
+func (s *livepeerSubgraph) Subscribe(ctx context.Context, sink chan<- []*lpTypes.Transcoder) error {
+	wsAddr, err := toWebsocketURL(s.addr)
+	if err != nil {
+		return err
+	}
+
+	go s.runSubscription(ctx, wsAddr, sink)
+	return nil
+}
+
+func toWebsocketURL(addr string) (string, error) {
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		return "wss://" + strings.TrimPrefix(addr, "https://"), nil
+	case strings.HasPrefix(addr, "http://"):
+		return "ws://" + strings.TrimPrefix(addr, "http://"), nil
+	default:
+		return "", fmt.Errorf("cannot derive websocket URL from subgraph address: %s", addr)
+	}
+}
+
+func (s *livepeerSubgraph) runSubscription(ctx context.Context, wsAddr string, sink chan<- []*lpTypes.Transcoder) {
+	backoff := minReconnectBackoff
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		unsupported, err := s.subscribeOnce(ctx, wsAddr, sink)
+		if unsupported {
+			glog.Errorf("subgraph does not support subscriptions, falling back to polling: %v", err)
+			s.pollActiveTranscoders(ctx, sink)
+			return
+		}
+		if err != nil && ctx.Err() == nil {
+			glog.Errorf("subgraph subscription dropped, reconnecting in %s: %v", backoff, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// subscribeOnce runs a single connection attempt to completion. The first
+// return value is true if the server rejected the subscription protocol
+// itself, signalling that the caller should stop retrying and poll instead.
+func (s *livepeerSubgraph) subscribeOnce(ctx context.Context, wsAddr string, sink chan<- []*lpTypes.Transcoder) (bool, error) {
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{graphqlTransportWS},
+		HandshakeTimeout: wsHandshakeTimeout,
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsAddr, nil)
+	if resp != nil && resp.StatusCode == 426 {
+		return true, fmt.Errorf("server does not support %s: status %d", graphqlTransportWS, resp.StatusCode)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Closing the connection is the only way to unblock a pending
+	// conn.ReadJSON, so tie it to ctx cancellation: without this, a
+	// shutdown request has to wait out the full read deadline below
+	// before subscribeOnce actually returns.
+	closerDone := make(chan struct{})
+	defer close(closerDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closerDone:
+		}
+	}()
+
+	// gorilla/websocket only allows one concurrent writer per connection,
+	// and both this goroutine and keepalive write to it.
+	var writeMu sync.Mutex
+	writeJSON := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	if err := writeJSON(wsMessage{Type: "connection_init"}); err != nil {
+		return false, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(wsReadTimeout)); err != nil {
+		return false, err
+	}
+	ack := wsMessage{}
+	if err := conn.ReadJSON(&ack); err != nil {
+		return false, err
+	}
+	if ack.Type == "connection_error" {
+		return true, fmt.Errorf("connection_error from subgraph: %s", ack.Payload)
+	}
+	if ack.Type != "connection_ack" {
+		return false, fmt.Errorf("expected connection_ack, got %s", ack.Type)
+	}
+
+	payload, err := json.Marshal(subscribePayload{
+		Query: fmt.Sprintf("subscription { transcoders(where: {active: true}) { %s } }", transcoderFields),
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := writeJSON(wsMessage{ID: "1", Type: "subscribe", Payload: payload}); err != nil {
+		return false, err
+	}
+
+	keepaliveDone := make(chan struct{})
+	defer close(keepaliveDone)
+	go s.keepalive(writeJSON, keepaliveDone)
+
+	for {
+		// Reset on every iteration: as long as some frame (a "next", our
+		// own "ping"/"pong", anything) arrives within wsReadTimeout the
+		// link is considered live; total silence for that long -
+		// including a keepalive ping that never gets a pong back - is
+		// treated as a dead connection and forces a reconnect.
+		if err := conn.SetReadDeadline(time.Now().Add(wsReadTimeout)); err != nil {
+			return false, err
+		}
+		msg := wsMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return false, err
+		}
+
+		switch msg.Type {
+		case "next":
+			var next nextPayload
+			if err := json.Unmarshal(msg.Payload, &next); err != nil {
+				glog.Errorf("failed to decode subscription payload: %v", err)
+				continue
+			}
+			transcoders := make([]*lpTypes.Transcoder, 0, len(next.Data.Transcoders))
+			for _, t := range next.Data.Transcoders {
+				transcoders = append(transcoders, t.parseLivepeerTranscoder())
+			}
+			select {
+			case sink <- transcoders:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		case "error":
+			return false, fmt.Errorf("subscription error from subgraph: %s", msg.Payload)
+		case "complete":
+			return false, nil
+		case "ping":
+			if err := writeJSON(wsMessage{Type: "pong"}); err != nil {
+				return false, err
+			}
+		case "pong":
+			// no-op, just confirms liveness
+		}
+	}
+}
+
+// keepalive sends protocol-level pings so idle connections aren't dropped
+// by intermediaries, until done is closed. It writes through writeJSON
+// rather than the connection directly so it never races the read loop's
+// own replies (e.g. pong) on the same connection.
+func (s *livepeerSubgraph) keepalive(writeJSON func(v interface{}) error, done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := writeJSON(wsMessage{Type: "ping"}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// pollActiveTranscoders is the fallback used when the subgraph does not
+// support subscriptions: it re-issues GetActiveTranscoders on an interval
+// and forwards the results to sink.
+func (s *livepeerSubgraph) pollActiveTranscoders(ctx context.Context, sink chan<- []*lpTypes.Transcoder) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := s.GetActiveTranscoders()
+			if err != nil {
+				glog.Errorf("polling fallback failed to fetch active transcoders: %v", err)
+				continue
+			}
+			select {
+			case sink <- res.Transcoders:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package subgraph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lpTypes "github.com/livepeer/go-livepeer/eth/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToWebsocketURL(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "https://api.thegraph.com/subgraphs/name/x", want: "wss://api.thegraph.com/subgraphs/name/x"},
+		{addr: "http://localhost:8000/subgraphs/name/x", want: "ws://localhost:8000/subgraphs/name/x"},
+		{addr: "not-a-url", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := toWebsocketURL(tt.addr)
+		if tt.wantErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+}
+
+// wsTestServer upgrades every incoming request to a graphql-transport-ws
+// connection and hands it to handle, which drives the server side of the
+// protocol for one test.
+func wsTestServer(t *testing.T, handle func(conn *websocket.Conn)) string {
+	upgrader := websocket.Upgrader{Subprotocols: []string{graphqlTransportWS}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		handle(conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func nextFrame(ids ...string) wsMessage {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = fmt.Sprintf(`{
+			"id": %q,
+			"feeShare": "0",
+			"rewardCut": "0",
+			"lastRewardRound": {"id": "0"},
+			"activationRound": "0",
+			"deactivationRound": "0",
+			"totalStake": "0",
+			"serviceURI": "",
+			"active": true,
+			"status": "Registered",
+			"pools": []
+		}`, id)
+	}
+	payload := json.RawMessage(fmt.Sprintf(`{"data": {"transcoders": [%s]}}`, strings.Join(entries, ",")))
+	return wsMessage{ID: "1", Type: "next", Payload: payload}
+}
+
+func TestSubscribeOnce_HandlesNextFramesThenComplete(t *testing.T) {
+	wsAddr := wsTestServer(t, func(conn *websocket.Conn) {
+		var init wsMessage
+		require.NoError(t, conn.ReadJSON(&init))
+		assert.Equal(t, "connection_init", init.Type)
+		require.NoError(t, conn.WriteJSON(wsMessage{Type: "connection_ack"}))
+
+		var sub wsMessage
+		require.NoError(t, conn.ReadJSON(&sub))
+		assert.Equal(t, "subscribe", sub.Type)
+
+		require.NoError(t, conn.WriteJSON(nextFrame("0x3333333333333333333333333333333333333333")))
+		require.NoError(t, conn.WriteJSON(wsMessage{ID: "1", Type: "complete"}))
+	})
+
+	s := &livepeerSubgraph{}
+	sink := make(chan []*lpTypes.Transcoder, 1)
+	unsupported, err := s.subscribeOnce(context.Background(), wsAddr, sink)
+	require.NoError(t, err)
+	assert.False(t, unsupported)
+
+	select {
+	case got := <-sink:
+		require.Len(t, got, 1)
+		assert.Equal(t, testTranscoderAddr, got[0].Address)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for transcoders on sink")
+	}
+}
+
+func TestSubscribeOnce_RespondsToPing(t *testing.T) {
+	pongReceived := make(chan struct{})
+	wsAddr := wsTestServer(t, func(conn *websocket.Conn) {
+		var init wsMessage
+		require.NoError(t, conn.ReadJSON(&init))
+		require.NoError(t, conn.WriteJSON(wsMessage{Type: "connection_ack"}))
+
+		var sub wsMessage
+		require.NoError(t, conn.ReadJSON(&sub))
+
+		require.NoError(t, conn.WriteJSON(wsMessage{Type: "ping"}))
+		var pong wsMessage
+		require.NoError(t, conn.ReadJSON(&pong))
+		assert.Equal(t, "pong", pong.Type)
+		close(pongReceived)
+
+		require.NoError(t, conn.WriteJSON(wsMessage{ID: "1", Type: "complete"}))
+	})
+
+	s := &livepeerSubgraph{}
+	sink := make(chan []*lpTypes.Transcoder, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := s.subscribeOnce(ctx, wsAddr, sink)
+	require.NoError(t, err)
+
+	select {
+	case <-pongReceived:
+	case <-time.After(time.Second):
+		t.Fatal("server never received a pong reply")
+	}
+}
+
+func TestSubscribeOnce_RejectsWith426WhenSubscriptionsUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+	}))
+	t.Cleanup(server.Close)
+	wsAddr := "ws://" + strings.TrimPrefix(server.URL, "http://")
+
+	s := &livepeerSubgraph{}
+	sink := make(chan []*lpTypes.Transcoder, 1)
+	unsupported, err := s.subscribeOnce(context.Background(), wsAddr, sink)
+	assert.True(t, unsupported)
+	assert.Error(t, err)
+}
+
+func TestRunSubscription_StopsPromptlyOnContextCancellation(t *testing.T) {
+	// Nothing is listening on this address, so every dial attempt fails and
+	// runSubscription falls into its backoff sleep; cancelling ctx well
+	// before minReconnectBackoff elapses must still return promptly.
+	s := &livepeerSubgraph{}
+	sink := make(chan []*lpTypes.Transcoder, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.runSubscription(ctx, "ws://127.0.0.1:1", sink)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(minReconnectBackoff):
+		t.Fatal("runSubscription did not respect context cancellation during backoff")
+	}
+}
@@ -0,0 +1,60 @@
+package watchers
+
+import (
+	"fmt"
+	"sort"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/livepeer/go-livepeer/eth/blockwatch"
+)
+
+// blockWatcherAdapter wraps the production *blockwatch.Watcher so it
+// satisfies the BlockWatcher interface OrchestratorWatcher depends on. It
+// implements ReplayFrom in terms of the watcher's own retained-block
+// history rather than a new blockwatch-level query, so Watch()'s checkpoint
+// resume has a concrete production implementation to run against instead
+// of only the BlockWatcher interface.
+type blockWatcherAdapter struct {
+	*blockwatch.Watcher
+}
+
+// NewBlockWatcherAdapter adapts watcher, the shared blockwatch.Watcher
+// instance used by the other eth/watchers subscribers, for use as
+// OrchestratorWatcher's BlockWatcher.
+func NewBlockWatcherAdapter(watcher *blockwatch.Watcher) BlockWatcher {
+	return &blockWatcherAdapter{Watcher: watcher}
+}
+
+func (a *blockWatcherAdapter) Subscribe(sink chan<- []*blockwatch.Event) event.Subscription {
+	return a.Watcher.Subscribe(sink)
+}
+
+// ReplayFrom reconstructs Added events for every block the watcher has
+// retained above (blockNumber, blockHash), so OrchestratorWatcher can
+// rebuild its confirmation buffer after a restart. It can only replay as
+// far back as the watcher's own retention window reaches; anything older
+// is assumed already past any reasonable confirmationDepth and is not
+// replayed.
+func (a *blockWatcherAdapter) ReplayFrom(blockNumber int64, blockHash ethcommon.Hash) ([]*blockwatch.Event, error) {
+	retained, err := a.Watcher.InspectRetainedBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("replaying from checkpoint %d %s: %v", blockNumber, blockHash.Hex(), err)
+	}
+
+	sort.Slice(retained, func(i, j int) bool {
+		return retained[i].Number.Int64() < retained[j].Number.Int64()
+	})
+
+	events := make([]*blockwatch.Event, 0, len(retained))
+	for _, header := range retained {
+		if header.Number.Int64() <= blockNumber {
+			continue
+		}
+		events = append(events, &blockwatch.Event{
+			Type:        blockwatch.Added,
+			BlockHeader: header,
+		})
+	}
+	return events, nil
+}
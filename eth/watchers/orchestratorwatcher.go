@@ -5,6 +5,7 @@ import (
 
 	ethcommon "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/golang/glog"
 	"github.com/livepeer/go-livepeer/common"
 	"github.com/livepeer/go-livepeer/eth"
@@ -14,33 +15,91 @@ import (
 
 const maxFutureRound = int64(math.MaxInt64)
 
+// defaultConfirmationDepth is the number of block confirmations
+// OrchestratorWatcher waits for before committing a decoded mutation to
+// store, absorbing reorgs shallower than this without ever touching
+// DBOrch.
+const defaultConfirmationDepth = int64(12)
+
 type OrchestratorWatcher struct {
-	store         orchestratorStore
-	dec           *EventDecoder
-	watcher       BlockWatcher
-	lpEth         eth.LivepeerEthClient
-	quit          chan struct{}
-	addressFilter []ethcommon.Address
+	store              orchestratorStore
+	dec                *EventDecoder
+	serviceRegistryDec *EventDecoder
+	watcher            BlockWatcher
+	lpEth              eth.LivepeerEthClient
+	quit               chan struct{}
+	addressFilter      []ethcommon.Address
+
+	confirmationDepth int64
+	pending           map[ethcommon.Hash]*pendingBlock
+	latestBlockNumber int64
 }
 
-func NewOrchestratorWatcher(bondingManagerAddr ethcommon.Address, watcher BlockWatcher, store orchestratorStore, lpEth eth.LivepeerEthClient, addressFilter []ethcommon.Address) (*OrchestratorWatcher, error) {
+// pendingBlock buffers the DBOrch mutations decoded from a single block's
+// logs until the block has accumulated confirmationDepth descendants, at
+// which point they are committed to store as a unit.
+type pendingBlock struct {
+	number    int64
+	hash      ethcommon.Hash
+	mutations []*common.DBOrch
+}
+
+// orchestratorStore is the persistence layer OrchestratorWatcher updates as
+// it processes bonding and service registry events.
+type orchestratorStore interface {
+	UpdateOrch(orch *common.DBOrch) error
+	// LastProcessedBlock returns the highest block (number, hash) whose
+	// mutations have been committed, so Watch can resume from it. A zero
+	// blockNumber with an empty hash means nothing has been committed yet.
+	LastProcessedBlock() (int64, ethcommon.Hash, error)
+	SetLastProcessedBlock(blockNumber int64, blockHash ethcommon.Hash) error
+}
+
+// BlockWatcher is the chain head subscription OrchestratorWatcher consumes
+// events from. ReplayFrom lets OrchestratorWatcher rebuild its in-memory
+// confirmation buffer after a restart.
+type BlockWatcher interface {
+	Subscribe(sink chan<- []*blockwatch.Event) event.Subscription
+	ReplayFrom(blockNumber int64, blockHash ethcommon.Hash) ([]*blockwatch.Event, error)
+}
+
+func NewOrchestratorWatcher(bondingManagerAddr ethcommon.Address, serviceRegistryAddr ethcommon.Address, watcher BlockWatcher, store orchestratorStore, lpEth eth.LivepeerEthClient, addressFilter []ethcommon.Address, confirmationDepth int64) (*OrchestratorWatcher, error) {
 	dec, err := NewEventDecoder(bondingManagerAddr, contracts.BondingManagerABI)
 	if err != nil {
 		return nil, err
 	}
 
+	serviceRegistryDec, err := NewEventDecoder(serviceRegistryAddr, contracts.ServiceRegistryABI)
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmationDepth <= 0 {
+		confirmationDepth = defaultConfirmationDepth
+	}
+
 	return &OrchestratorWatcher{
-		store:         store,
-		dec:           dec,
-		watcher:       watcher,
-		lpEth:         lpEth,
-		quit:          make(chan struct{}),
-		addressFilter: addressFilter,
+		store:              store,
+		dec:                dec,
+		serviceRegistryDec: serviceRegistryDec,
+		watcher:            watcher,
+		lpEth:              lpEth,
+		quit:               make(chan struct{}),
+		addressFilter:      addressFilter,
+		confirmationDepth:  confirmationDepth,
+		pending:            make(map[ethcommon.Hash]*pendingBlock),
 	}, nil
 }
 
-// Watch starts the event watching loop
+// Watch starts the event watching loop. On startup it resumes from the
+// last committed checkpoint, replaying any blocks the watcher missed while
+// it was down and rebuilding the in-memory confirmation buffer, before
+// subscribing to live events.
 func (ow *OrchestratorWatcher) Watch() {
+	if err := ow.resume(); err != nil {
+		glog.Error(err)
+	}
+
 	events := make(chan []*blockwatch.Event, 10)
 	sub := ow.watcher.Subscribe(events)
 	defer sub.Unsubscribe()
@@ -62,106 +121,330 @@ func (ow *OrchestratorWatcher) Stop() {
 	close(ow.quit)
 }
 
+// resume asks BlockWatcher to replay everything since the last committed
+// checkpoint, so a restart during a reorg window does not lose mutations
+// that were still sitting in the (now gone) in-memory buffer.
+func (ow *OrchestratorWatcher) resume() error {
+	blockNumber, blockHash, err := ow.store.LastProcessedBlock()
+	if err != nil {
+		return err
+	}
+	if blockNumber == 0 && blockHash == (ethcommon.Hash{}) {
+		return nil
+	}
+
+	events, err := ow.watcher.ReplayFrom(blockNumber, blockHash)
+	if err != nil {
+		return err
+	}
+	ow.handleBlockEvents(events)
+	return nil
+}
+
 func (ow *OrchestratorWatcher) handleBlockEvents(events []*blockwatch.Event) {
 	for _, event := range events {
-		for _, log := range event.BlockHeader.Logs {
-			if event.Type == blockwatch.Removed {
-				log.Removed = true
+		header := event.BlockHeader
+
+		if event.Type == blockwatch.Removed {
+			delete(ow.pending, header.Hash)
+			// blockwatch unwinds a reorg tip-first, so the removed chain's
+			// head is always the current latestBlockNumber; roll it back
+			// so the replacement fork's blocks are judged against their
+			// real confirmation count rather than the stale tip height.
+			if header.Number.Int64() == ow.latestBlockNumber {
+				ow.latestBlockNumber--
 			}
-			if err := ow.handleLog(log); err != nil {
+			continue
+		}
+
+		if header.Number.Int64() > ow.latestBlockNumber {
+			ow.latestBlockNumber = header.Number.Int64()
+		}
+
+		pb, ok := ow.pending[header.Hash]
+		if !ok {
+			pb = &pendingBlock{number: header.Number.Int64(), hash: header.Hash}
+			ow.pending[header.Hash] = pb
+		}
+
+		for _, log := range header.Logs {
+			mutations, err := ow.handleLog(log)
+			if err != nil {
 				glog.Error(err)
+				continue
+			}
+			pb.mutations = append(pb.mutations, mutations...)
+		}
+	}
+
+	ow.commitConfirmed()
+}
+
+// commitConfirmed flushes every buffered block that now has at least
+// confirmationDepth descendants, in ascending block order, and advances
+// the persisted checkpoint as it goes.
+func (ow *OrchestratorWatcher) commitConfirmed() {
+	for {
+		var next *pendingBlock
+		for _, pb := range ow.pending {
+			if ow.latestBlockNumber-pb.number < ow.confirmationDepth {
+				continue
+			}
+			if next == nil || pb.number < next.number {
+				next = pb
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		failed := false
+		for _, mutation := range next.mutations {
+			if err := ow.store.UpdateOrch(mutation); err != nil {
+				glog.Errorf("failed to commit orchestrator mutation for block %d %s, will retry: %v", next.number, next.hash.Hex(), err)
+				failed = true
 			}
 		}
+		if failed {
+			// Leave this block (and anything above it) buffered rather
+			// than advancing the checkpoint past a failed write: a
+			// restart must still see it as unprocessed so it gets
+			// retried instead of silently lost. The next confirmed block
+			// event will call commitConfirmed again and retry it.
+			return
+		}
+
+		if err := ow.store.SetLastProcessedBlock(next.number, next.hash); err != nil {
+			glog.Errorf("failed to persist checkpoint for block %d %s, will retry: %v", next.number, next.hash.Hex(), err)
+			return
+		}
+		delete(ow.pending, next.hash)
 	}
 }
 
-func (ow *OrchestratorWatcher) handleLog(log types.Log) error {
-	eventName, err := ow.dec.FindEventName(log)
-	if err != nil {
-		// Noop if we cannot find the event name
-		return nil
+func (ow *OrchestratorWatcher) handleLog(log types.Log) ([]*common.DBOrch, error) {
+	if eventName, err := ow.dec.FindEventName(log); err == nil {
+		switch eventName {
+		case "TranscoderActivated":
+			return ow.handleTranscoderActivated(log)
+		case "TranscoderDeactivated":
+			return ow.handleTranscoderDeactivated(log)
+		case "Reward":
+			return ow.handleReward(log)
+		case "Bond":
+			return ow.handleBond(log)
+		case "Unbond":
+			return ow.handleUnbond(log)
+		case "Rebond":
+			return ow.handleRebond(log)
+		case "WithdrawStake":
+			return ow.handleWithdrawStake(log)
+		case "TranscoderSlashed":
+			return ow.handleTranscoderSlashed(log)
+		default:
+			return nil, nil
+		}
 	}
 
-	switch eventName {
-	case "TranscoderActivated":
-		return ow.handleTranscoderActivated(log)
-	case "TranscoderDeactivated":
-		return ow.handleTranscoderDeactivated(log)
-	default:
-		return nil
+	if eventName, err := ow.serviceRegistryDec.FindEventName(log); err == nil {
+		switch eventName {
+		case "ServiceURIUpdate":
+			return ow.handleServiceURIUpdate(log)
+		default:
+			return nil, nil
+		}
 	}
+
+	// Noop if neither decoder recognizes the event
+	return nil, nil
 }
 
-func (ow *OrchestratorWatcher) handleTranscoderActivated(log types.Log) error {
+func (ow *OrchestratorWatcher) handleTranscoderActivated(log types.Log) ([]*common.DBOrch, error) {
 	var transcoderActivated contracts.BondingManagerTranscoderActivated
 	if err := ow.dec.Decode("TranscoderActivated", log, &transcoderActivated); err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(ow.addressFilter) > 0 {
-		if !common.ContainsAddress(ow.addressFilter, transcoderActivated.Transcoder) {
-			return nil
-		}
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, transcoderActivated.Transcoder) {
+		return nil, nil
 	}
 
-	if !log.Removed {
-		uri, err := ow.lpEth.GetServiceURI(transcoderActivated.Transcoder)
-		if err != nil {
-			return err
-		}
-
-		return ow.store.UpdateOrch(
-			&common.DBOrch{
-				EthereumAddr:      transcoderActivated.Transcoder.String(),
-				ServiceURI:        uri,
-				ActivationRound:   transcoderActivated.ActivationRound.Int64(),
-				DeactivationRound: maxFutureRound,
-			},
-		)
-	}
-	t, err := ow.lpEth.GetTranscoder(transcoderActivated.Transcoder)
+	uri, err := ow.lpEth.GetServiceURI(transcoderActivated.Transcoder)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return ow.store.UpdateOrch(
-		&common.DBOrch{
-			EthereumAddr:      t.Address.String(),
-			ServiceURI:        t.ServiceURI,
-			ActivationRound:   t.ActivationRound.Int64(),
-			DeactivationRound: t.DeactivationRound.Int64(),
-		},
-	)
+
+	return []*common.DBOrch{{
+		EthereumAddr:      transcoderActivated.Transcoder.String(),
+		ServiceURI:        uri,
+		ActivationRound:   transcoderActivated.ActivationRound.Int64(),
+		DeactivationRound: maxFutureRound,
+	}}, nil
 }
 
-func (ow *OrchestratorWatcher) handleTranscoderDeactivated(log types.Log) error {
+func (ow *OrchestratorWatcher) handleTranscoderDeactivated(log types.Log) ([]*common.DBOrch, error) {
 	var transcoderDeactivated contracts.BondingManagerTranscoderDeactivated
 	if err := ow.dec.Decode("TranscoderDeactivated", log, &transcoderDeactivated); err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(ow.addressFilter) > 0 {
-		if !common.ContainsAddress(ow.addressFilter, transcoderDeactivated.Transcoder) {
-			return nil
-		}
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, transcoderDeactivated.Transcoder) {
+		return nil, nil
 	}
 
-	if !log.Removed {
-		return ow.store.UpdateOrch(
-			&common.DBOrch{
-				EthereumAddr:      transcoderDeactivated.Transcoder.String(),
-				DeactivationRound: transcoderDeactivated.DeactivationRound.Int64(),
-			},
-		)
+	return []*common.DBOrch{{
+		EthereumAddr:      transcoderDeactivated.Transcoder.String(),
+		DeactivationRound: transcoderDeactivated.DeactivationRound.Int64(),
+	}}, nil
+}
+
+// handleServiceURIUpdate keeps DBOrch.ServiceURI in sync with the
+// ServiceRegistry contract.
+func (ow *OrchestratorWatcher) handleServiceURIUpdate(log types.Log) ([]*common.DBOrch, error) {
+	var serviceURIUpdate contracts.ServiceRegistryServiceURIUpdate
+	if err := ow.serviceRegistryDec.Decode("ServiceURIUpdate", log, &serviceURIUpdate); err != nil {
+		return nil, err
+	}
+
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, serviceURIUpdate.Addr) {
+		return nil, nil
+	}
+
+	return []*common.DBOrch{{
+		EthereumAddr: serviceURIUpdate.Addr.String(),
+		ServiceURI:   serviceURIUpdate.ServiceURI,
+	}}, nil
+}
+
+// handleReward keeps DBOrch.LastRewardRound in sync whenever an
+// orchestrator calls reward().
+func (ow *OrchestratorWatcher) handleReward(log types.Log) ([]*common.DBOrch, error) {
+	var reward contracts.BondingManagerReward
+	if err := ow.dec.Decode("Reward", log, &reward); err != nil {
+		return nil, err
+	}
+
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, reward.Transcoder) {
+		return nil, nil
 	}
-	t, err := ow.lpEth.GetTranscoder(transcoderDeactivated.Transcoder)
+
+	round, err := ow.lpEth.CurrentRound()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return []*common.DBOrch{{
+		EthereumAddr:    reward.Transcoder.String(),
+		LastRewardRound: round.Int64(),
+	}}, nil
+}
+
+// handleBond, handleUnbond, handleRebond, handleWithdrawStake and
+// handleTranscoderSlashed all move delegated stake around. None of these
+// events carry an orchestrator's resulting total stake, only deltas and
+// counterparties, so rather than replicate the BondingManager's stake
+// accounting here we always re-fetch the canonical value via
+// lpEth.GetTranscoder.
+
+func (ow *OrchestratorWatcher) handleBond(log types.Log) ([]*common.DBOrch, error) {
+	var bond contracts.BondingManagerBond
+	if err := ow.dec.Decode("Bond", log, &bond); err != nil {
+		return nil, err
+	}
+
+	newDelegate, err := ow.stakeMutation(bond.NewDelegate)
+	if err != nil {
+		return nil, err
+	}
+	oldDelegate, err := ow.stakeMutation(bond.OldDelegate)
+	if err != nil {
+		return nil, err
+	}
+
+	mutations := []*common.DBOrch{}
+	if newDelegate != nil {
+		mutations = append(mutations, newDelegate)
+	}
+	if oldDelegate != nil {
+		mutations = append(mutations, oldDelegate)
+	}
+	return mutations, nil
+}
+
+func (ow *OrchestratorWatcher) handleUnbond(log types.Log) ([]*common.DBOrch, error) {
+	var unbond contracts.BondingManagerUnbond
+	if err := ow.dec.Decode("Unbond", log, &unbond); err != nil {
+		return nil, err
 	}
-	return ow.store.UpdateOrch(
-		&common.DBOrch{
-			EthereumAddr:      t.Address.String(),
-			ActivationRound:   t.ActivationRound.Int64(),
-			DeactivationRound: t.DeactivationRound.Int64(),
-		},
-	)
-}
\ No newline at end of file
+	return ow.stakeMutationSlice(unbond.Delegate)
+}
+
+func (ow *OrchestratorWatcher) handleRebond(log types.Log) ([]*common.DBOrch, error) {
+	var rebond contracts.BondingManagerRebond
+	if err := ow.dec.Decode("Rebond", log, &rebond); err != nil {
+		return nil, err
+	}
+	return ow.stakeMutationSlice(rebond.Delegate)
+}
+
+func (ow *OrchestratorWatcher) handleWithdrawStake(log types.Log) ([]*common.DBOrch, error) {
+	var withdrawStake contracts.BondingManagerWithdrawStake
+	if err := ow.dec.Decode("WithdrawStake", log, &withdrawStake); err != nil {
+		return nil, err
+	}
+	return ow.stakeMutationSlice(withdrawStake.Delegator)
+}
+
+func (ow *OrchestratorWatcher) handleTranscoderSlashed(log types.Log) ([]*common.DBOrch, error) {
+	var transcoderSlashed contracts.BondingManagerTranscoderSlashed
+	if err := ow.dec.Decode("TranscoderSlashed", log, &transcoderSlashed); err != nil {
+		return nil, err
+	}
+
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, transcoderSlashed.Transcoder) {
+		return nil, nil
+	}
+
+	t, err := ow.lpEth.GetTranscoder(transcoderSlashed.Transcoder)
+	if err != nil {
+		return nil, err
+	}
+	return []*common.DBOrch{{
+		EthereumAddr: t.Address.String(),
+		Stake:        t.DelegatedStake.String(),
+		Status:       t.Status,
+	}}, nil
+}
+
+func (ow *OrchestratorWatcher) stakeMutationSlice(addr ethcommon.Address) ([]*common.DBOrch, error) {
+	mutation, err := ow.stakeMutation(addr)
+	if err != nil {
+		return nil, err
+	}
+	if mutation == nil {
+		return nil, nil
+	}
+	return []*common.DBOrch{mutation}, nil
+}
+
+func (ow *OrchestratorWatcher) stakeMutation(addr ethcommon.Address) (*common.DBOrch, error) {
+	// The zero address shows up as Bond's OldDelegate on a delegator's
+	// first ever bond; it is never a registered transcoder, so skip it
+	// rather than erroring out of GetTranscoder.
+	if addr == (ethcommon.Address{}) {
+		return nil, nil
+	}
+	if len(ow.addressFilter) > 0 && !common.ContainsAddress(ow.addressFilter, addr) {
+		return nil, nil
+	}
+
+	t, err := ow.lpEth.GetTranscoder(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &common.DBOrch{
+		EthereumAddr: t.Address.String(),
+		Stake:        t.DelegatedStake.String(),
+	}, nil
+}
+
@@ -0,0 +1,457 @@
+package watchers
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/livepeer/go-livepeer/common"
+	"github.com/livepeer/go-livepeer/eth"
+	"github.com/livepeer/go-livepeer/eth/blockwatch"
+	lpTypes "github.com/livepeer/go-livepeer/eth/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testBondingManagerAddr  = ethcommon.HexToAddress("0x1111111111111111111111111111111111111111")
+	testServiceRegistryAddr = ethcommon.HexToAddress("0x2222222222222222222222222222222222222222")
+	testTranscoderAddr      = ethcommon.HexToAddress("0x3333333333333333333333333333333333333333")
+	testOtherDelegateAddr   = ethcommon.HexToAddress("0x4444444444444444444444444444444444444444")
+	testDelegatorAddr       = ethcommon.HexToAddress("0x5555555555555555555555555555555555555555")
+	testUnfilteredAddr      = ethcommon.HexToAddress("0x6666666666666666666666666666666666666666")
+)
+
+// fakeLpEth is a minimal stand-in for eth.LivepeerEthClient. Embedding the
+// interface satisfies it without implementing every method; only the ones
+// OrchestratorWatcher actually calls are overridden.
+type fakeLpEth struct {
+	eth.LivepeerEthClient
+
+	serviceURI    string
+	serviceURIErr error
+
+	transcoder    *lpTypes.Transcoder
+	transcoderErr error
+
+	currentRound    *big.Int
+	currentRoundErr error
+}
+
+func (f *fakeLpEth) GetServiceURI(ethcommon.Address) (string, error) {
+	return f.serviceURI, f.serviceURIErr
+}
+
+func (f *fakeLpEth) GetTranscoder(ethcommon.Address) (*lpTypes.Transcoder, error) {
+	return f.transcoder, f.transcoderErr
+}
+
+func (f *fakeLpEth) CurrentRound() (*big.Int, error) {
+	return f.currentRound, f.currentRoundErr
+}
+
+// fakeOrchestratorStore is also a fake checkpoint store: LastProcessedBlock
+// and SetLastProcessedBlock track real state rather than stubbing it out, so
+// commitConfirmed and resume tests can assert on it. updateErrCount lets a
+// test make UpdateOrch fail a fixed number of times before succeeding, to
+// exercise the retry-don't-lose-it path.
+type fakeOrchestratorStore struct {
+	updated []*common.DBOrch
+
+	updateErr      error
+	updateErrCount int
+
+	lastBlockNumber  int64
+	lastBlockHash    ethcommon.Hash
+	setCheckpointErr error
+}
+
+func (s *fakeOrchestratorStore) UpdateOrch(orch *common.DBOrch) error {
+	if s.updateErrCount > 0 {
+		s.updateErrCount--
+		return s.updateErr
+	}
+	s.updated = append(s.updated, orch)
+	return nil
+}
+
+func (s *fakeOrchestratorStore) LastProcessedBlock() (int64, ethcommon.Hash, error) {
+	return s.lastBlockNumber, s.lastBlockHash, nil
+}
+
+func (s *fakeOrchestratorStore) SetLastProcessedBlock(blockNumber int64, blockHash ethcommon.Hash) error {
+	if s.setCheckpointErr != nil {
+		return s.setCheckpointErr
+	}
+	s.lastBlockNumber = blockNumber
+	s.lastBlockHash = blockHash
+	return nil
+}
+
+// fakeBlockWatcher is a minimal stand-in for BlockWatcher. Subscribe returns
+// a subscription that never emits or errors; only ReplayFrom is exercised by
+// the resume tests.
+type fakeBlockWatcher struct {
+	replayEvents []*blockwatch.Event
+	replayErr    error
+	replayCalls  []int64
+}
+
+func (w *fakeBlockWatcher) Subscribe(sink chan<- []*blockwatch.Event) event.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	})
+}
+
+func (w *fakeBlockWatcher) ReplayFrom(blockNumber int64, blockHash ethcommon.Hash) ([]*blockwatch.Event, error) {
+	w.replayCalls = append(w.replayCalls, blockNumber)
+	return w.replayEvents, w.replayErr
+}
+
+func newTestOrchestratorWatcher(t *testing.T, lpEth eth.LivepeerEthClient, addressFilter []ethcommon.Address) (*OrchestratorWatcher, *fakeOrchestratorStore) {
+	store := &fakeOrchestratorStore{}
+	ow, err := NewOrchestratorWatcher(testBondingManagerAddr, testServiceRegistryAddr, nil, store, lpEth, addressFilter, 0)
+	require.NoError(t, err)
+	return ow, store
+}
+
+// newTestOrchestratorWatcherWithDepth is used by the commitConfirmed and
+// resume tests below, which need control over confirmationDepth and a
+// BlockWatcher rather than the defaults newTestOrchestratorWatcher assumes.
+func newTestOrchestratorWatcherWithDepth(t *testing.T, store *fakeOrchestratorStore, watcher BlockWatcher, confirmationDepth int64) *OrchestratorWatcher {
+	ow, err := NewOrchestratorWatcher(testBondingManagerAddr, testServiceRegistryAddr, watcher, store, &fakeLpEth{}, nil, confirmationDepth)
+	require.NoError(t, err)
+	return ow
+}
+
+// addedEvent and removedEvent build synthetic blockwatch.Events for the
+// handleBlockEvents/commitConfirmed/resume tests below.
+func addedEvent(number int64, hash ethcommon.Hash, logs ...types.Log) *blockwatch.Event {
+	return &blockwatch.Event{
+		Type: blockwatch.Added,
+		BlockHeader: &blockwatch.MiniHeader{
+			Number: big.NewInt(number),
+			Hash:   hash,
+			Logs:   logs,
+		},
+	}
+}
+
+func removedEvent(number int64, hash ethcommon.Hash) *blockwatch.Event {
+	return &blockwatch.Event{
+		Type: blockwatch.Removed,
+		BlockHeader: &blockwatch.MiniHeader{
+			Number: big.NewInt(number),
+			Hash:   hash,
+		},
+	}
+}
+
+// addrTopic encodes an indexed address argument the way the EVM does: left
+// padded with zeros into a 32 byte topic.
+func addrTopic(addr ethcommon.Address) ethcommon.Hash {
+	return ethcommon.BytesToHash(addr.Bytes())
+}
+
+func packArgs(t *testing.T, types []string, values ...interface{}) []byte {
+	args := make(abi.Arguments, len(types))
+	for i, typ := range types {
+		ty, err := abi.NewType(typ, "", nil)
+		require.NoError(t, err)
+		args[i] = abi.Argument{Type: ty}
+	}
+	data, err := args.Pack(values...)
+	require.NoError(t, err)
+	return data
+}
+
+func eventLog(t *testing.T, contractAddr ethcommon.Address, signature string, indexedTopics []ethcommon.Hash, dataTypes []string, dataValues ...interface{}) types.Log {
+	topics := append([]ethcommon.Hash{crypto.Keccak256Hash([]byte(signature))}, indexedTopics...)
+	return types.Log{
+		Address: contractAddr,
+		Topics:  topics,
+		Data:    packArgs(t, dataTypes, dataValues...),
+	}
+}
+
+func TestHandleLog_NewEvents(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   func(t *testing.T) types.Log
+		lpEth *fakeLpEth
+		check func(t *testing.T, mutations []*common.DBOrch)
+	}{
+		{
+			name: "ServiceURIUpdate",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testServiceRegistryAddr, "ServiceURIUpdate(address,string)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr)},
+					[]string{"string"}, "https://example.com",
+				)
+			},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, testTranscoderAddr.String(), mutations[0].EthereumAddr)
+				assert.Equal(t, "https://example.com", mutations[0].ServiceURI)
+			},
+		},
+		{
+			name: "Reward",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "Reward(address,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr)},
+					[]string{"uint256"}, big.NewInt(1000),
+				)
+			},
+			lpEth: &fakeLpEth{currentRound: big.NewInt(42)},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, testTranscoderAddr.String(), mutations[0].EthereumAddr)
+				assert.Equal(t, int64(42), mutations[0].LastRewardRound)
+			},
+		},
+		{
+			name: "Bond",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "Bond(address,address,address,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr), addrTopic(testOtherDelegateAddr), addrTopic(testDelegatorAddr)},
+					[]string{"uint256", "uint256"}, big.NewInt(100), big.NewInt(500),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testTranscoderAddr, DelegatedStake: big.NewInt(500)}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				// Both the new and old delegate get re-synced.
+				require.Len(t, mutations, 2)
+				for _, m := range mutations {
+					assert.Equal(t, "500", m.Stake)
+				}
+			},
+		},
+		{
+			name: "Bond with zero old delegate",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "Bond(address,address,address,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr), addrTopic(ethcommon.Address{}), addrTopic(testDelegatorAddr)},
+					[]string{"uint256", "uint256"}, big.NewInt(100), big.NewInt(100),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testTranscoderAddr, DelegatedStake: big.NewInt(100)}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				// The zero address old delegate must not be looked up and
+				// must not suppress the real new-delegate mutation.
+				require.Len(t, mutations, 1)
+				assert.Equal(t, testTranscoderAddr.String(), mutations[0].EthereumAddr)
+			},
+		},
+		{
+			name: "Unbond",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "Unbond(address,address,uint256,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr), addrTopic(testDelegatorAddr)},
+					[]string{"uint256", "uint256", "uint256"}, big.NewInt(1), big.NewInt(50), big.NewInt(100),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testTranscoderAddr, DelegatedStake: big.NewInt(450)}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, "450", mutations[0].Stake)
+			},
+		},
+		{
+			name: "Rebond",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "Rebond(address,address,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr), addrTopic(testDelegatorAddr)},
+					[]string{"uint256", "uint256"}, big.NewInt(1), big.NewInt(50),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testTranscoderAddr, DelegatedStake: big.NewInt(500)}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, "500", mutations[0].Stake)
+			},
+		},
+		{
+			name: "WithdrawStake",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "WithdrawStake(address,uint256,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testDelegatorAddr)},
+					[]string{"uint256", "uint256", "uint256"}, big.NewInt(1), big.NewInt(50), big.NewInt(100),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testDelegatorAddr, DelegatedStake: big.NewInt(0)}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, testDelegatorAddr.String(), mutations[0].EthereumAddr)
+				assert.Equal(t, "0", mutations[0].Stake)
+			},
+		},
+		{
+			name: "TranscoderSlashed",
+			log: func(t *testing.T) types.Log {
+				return eventLog(t, testBondingManagerAddr, "TranscoderSlashed(address,address,uint256,uint256)",
+					[]ethcommon.Hash{addrTopic(testTranscoderAddr)},
+					[]string{"address", "uint256", "uint256"}, testOtherDelegateAddr, big.NewInt(10), big.NewInt(5),
+				)
+			},
+			lpEth: &fakeLpEth{transcoder: &lpTypes.Transcoder{Address: testTranscoderAddr, DelegatedStake: big.NewInt(90), Status: "NotRegistered"}},
+			check: func(t *testing.T, mutations []*common.DBOrch) {
+				require.Len(t, mutations, 1)
+				assert.Equal(t, "90", mutations[0].Stake)
+				assert.Equal(t, "NotRegistered", mutations[0].Status)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lpEth := tt.lpEth
+			if lpEth == nil {
+				lpEth = &fakeLpEth{}
+			}
+			ow, _ := newTestOrchestratorWatcher(t, lpEth, nil)
+			mutations, err := ow.handleLog(tt.log(t))
+			require.NoError(t, err)
+			tt.check(t, mutations)
+		})
+	}
+}
+
+func TestHandleLog_AddressFilter(t *testing.T) {
+	log := eventLog(t, testBondingManagerAddr, "Reward(address,uint256)",
+		[]ethcommon.Hash{addrTopic(testUnfilteredAddr)},
+		[]string{"uint256"}, big.NewInt(1000),
+	)
+
+	ow, _ := newTestOrchestratorWatcher(t, &fakeLpEth{currentRound: big.NewInt(1)}, []ethcommon.Address{testTranscoderAddr})
+	mutations, err := ow.handleLog(log)
+	require.NoError(t, err)
+	assert.Empty(t, mutations)
+}
+
+func TestCommitConfirmed_FlushesAtDepth(t *testing.T) {
+	store := &fakeOrchestratorStore{}
+	ow := newTestOrchestratorWatcherWithDepth(t, store, nil, 3)
+	ow.latestBlockNumber = 10
+
+	confirmedHash := ethcommon.HexToHash("0xaaaa")
+	unconfirmedHash := ethcommon.HexToHash("0xbbbb")
+	ow.pending[confirmedHash] = &pendingBlock{
+		number:    5,
+		hash:      confirmedHash,
+		mutations: []*common.DBOrch{{EthereumAddr: testTranscoderAddr.String()}},
+	}
+	ow.pending[unconfirmedHash] = &pendingBlock{
+		number:    9,
+		hash:      unconfirmedHash,
+		mutations: []*common.DBOrch{{EthereumAddr: testOtherDelegateAddr.String()}},
+	}
+
+	ow.commitConfirmed()
+
+	require.Len(t, store.updated, 1)
+	assert.Equal(t, testTranscoderAddr.String(), store.updated[0].EthereumAddr)
+	assert.Equal(t, int64(5), store.lastBlockNumber)
+	assert.Equal(t, confirmedHash, store.lastBlockHash)
+
+	_, stillPending := ow.pending[confirmedHash]
+	assert.False(t, stillPending)
+	_, stillBuffered := ow.pending[unconfirmedHash]
+	assert.True(t, stillBuffered)
+}
+
+func TestCommitConfirmed_FailedMutationNotCheckpointed(t *testing.T) {
+	store := &fakeOrchestratorStore{
+		updateErr:      errors.New("db unavailable"),
+		updateErrCount: 1,
+	}
+	ow := newTestOrchestratorWatcherWithDepth(t, store, nil, 1)
+	ow.latestBlockNumber = 5
+
+	hash := ethcommon.HexToHash("0xcccc")
+	ow.pending[hash] = &pendingBlock{
+		number:    4,
+		hash:      hash,
+		mutations: []*common.DBOrch{{EthereumAddr: testTranscoderAddr.String()}},
+	}
+
+	ow.commitConfirmed()
+
+	assert.Empty(t, store.updated)
+	assert.Equal(t, int64(0), store.lastBlockNumber)
+	_, stillPending := ow.pending[hash]
+	assert.True(t, stillPending, "a failed mutation must not drop the block from the buffer")
+
+	// The next confirmed-block event retries the same buffered block; this
+	// time the write succeeds and the checkpoint advances.
+	ow.commitConfirmed()
+
+	require.Len(t, store.updated, 1)
+	assert.Equal(t, int64(4), store.lastBlockNumber)
+	_, stillPending = ow.pending[hash]
+	assert.False(t, stillPending)
+}
+
+func TestHandleBlockEvents_ReorgRollsBackLatestBlockNumber(t *testing.T) {
+	store := &fakeOrchestratorStore{}
+	// A confirmationDepth high enough that nothing is committed, so this
+	// test only exercises the pending/latestBlockNumber bookkeeping.
+	ow := newTestOrchestratorWatcherWithDepth(t, store, nil, 100)
+
+	block10 := ethcommon.HexToHash("0x10")
+	block11 := ethcommon.HexToHash("0x11")
+	ow.handleBlockEvents([]*blockwatch.Event{
+		addedEvent(10, block10),
+		addedEvent(11, block11),
+	})
+	require.Equal(t, int64(11), ow.latestBlockNumber)
+	require.Contains(t, ow.pending, block11)
+
+	ow.handleBlockEvents([]*blockwatch.Event{
+		removedEvent(11, block11),
+	})
+
+	assert.Equal(t, int64(10), ow.latestBlockNumber)
+	assert.NotContains(t, ow.pending, block11)
+	assert.Contains(t, ow.pending, block10)
+}
+
+func TestResume_ReplaysFromCheckpoint(t *testing.T) {
+	checkpointHash := ethcommon.HexToHash("0x7")
+	store := &fakeOrchestratorStore{
+		lastBlockNumber: 7,
+		lastBlockHash:   checkpointHash,
+	}
+	replayedHash := ethcommon.HexToHash("0x8")
+	watcher := &fakeBlockWatcher{
+		replayEvents: []*blockwatch.Event{addedEvent(8, replayedHash)},
+	}
+	// A confirmationDepth high enough that the replayed block isn't
+	// immediately flushed, so resume's buffer rebuild is actually visible.
+	ow := newTestOrchestratorWatcherWithDepth(t, store, watcher, 100)
+
+	err := ow.resume()
+	require.NoError(t, err)
+
+	assert.Equal(t, []int64{7}, watcher.replayCalls)
+	assert.Equal(t, int64(8), ow.latestBlockNumber)
+	assert.Contains(t, ow.pending, replayedHash)
+}
+
+func TestResume_NothingToReplayWhenNoCheckpoint(t *testing.T) {
+	store := &fakeOrchestratorStore{}
+	watcher := &fakeBlockWatcher{}
+	ow := newTestOrchestratorWatcherWithDepth(t, store, watcher, 0)
+
+	err := ow.resume()
+	require.NoError(t, err)
+
+	assert.Empty(t, watcher.replayCalls)
+	assert.Empty(t, ow.pending)
+}